@@ -6,32 +6,380 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/aws/aws-sdk-go/service/route53"
 
 	"k8s.io/client-go/1.5/kubernetes"
 	"k8s.io/client-go/1.5/pkg/api"
 	"k8s.io/client-go/1.5/pkg/api/v1"
 	"k8s.io/client-go/1.5/pkg/labels"
+	"k8s.io/client-go/1.5/pkg/runtime"
+	"k8s.io/client-go/1.5/pkg/watch"
 	"k8s.io/client-go/1.5/rest"
+	"k8s.io/client-go/1.5/tools/cache"
 )
 
+// reconcileDebounce coalesces bursts of Service Add/Update/Delete events
+// (e.g. a rollout touching many Services at once) into a single reconcile.
+const reconcileDebounce = 2 * time.Second
+
+// reconcileResyncPeriod requests a reconcile on a timer, independent of
+// watch events, so a Service whose last attempt hit a transient AWS error
+// (and so was never marked applied, see reconcile's serviceFailed handling)
+// still gets retried instead of being stuck until its spec next changes.
+const reconcileResyncPeriod = 5 * time.Minute
+
+// reconcileRequested is signaled by the informer's event handlers; the main
+// loop drains and debounces it before running a reconcile pass.
+var reconcileRequested = make(chan struct{}, 1)
+
+func requestReconcile() {
+	select {
+	case reconcileRequested <- struct{}{}:
+	default:
+	}
+}
+
 // Don't actually commit the changes to route53 records, just print out what we would have done.
 var dryRun bool
 
+// Delete Route53 records for Services that no longer exist, are no longer
+// labeled for DNS management, or no longer claim a given domain.
+var prune bool
+
 func init() {
 	dryRunStr := os.Getenv("DRY_RUN")
 	if dryRunStr != "" {
 		dryRun = true
 	}
+
+	pruneStr := os.Getenv("PRUNE")
+	if pruneStr != "" {
+		prune = true
+	}
+
+	cnameTTL = defaultCNAMETTL
+	if ttlStr := os.Getenv("CNAME_TTL"); ttlStr != "" {
+		ttl, err := strconv.ParseInt(ttlStr, 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid CNAME_TTL %q: %v", ttlStr, err))
+		}
+		cnameTTL = ttl
+	}
+
+	if regions := os.Getenv("CNAME_REGIONS"); regions != "" {
+		for _, r := range strings.Split(regions, ",") {
+			cnameRegions[strings.TrimSpace(r)] = true
+		}
+	}
+
+	baseRoleARN = os.Getenv("AWS_ROLE_ARN")
+}
+
+// baseRoleARN, if set, is assumed for every Service's Route53 calls unless
+// overridden by the roleArnAnnotation. The elb client never assumes a role:
+// ELBs always live in the local account.
+var baseRoleARN string
+
+// roleArnAnnotation overrides baseRoleARN on a per-Service basis, letting
+// individual Services manage records in a different AWS account than the
+// one hosting the cluster.
+const roleArnAnnotation = "route53.amazonaws.com/roleArn"
+
+type roleClient struct {
+	client *route53.Route53
+	creds  *credentials.Credentials
+}
+
+var (
+	roleClientsMu sync.Mutex
+	// roleClients caches one *route53.Route53 per role ARN ("" for the base
+	// credentials) so we don't re-AssumeRole on every reconcile.
+	roleClients = map[string]*roleClient{}
+)
+
+// route53ClientForRole returns the cached Route53 client for roleARN,
+// assuming the role via STS and building a fresh client the first time it's
+// requested. Pass "" for the base (un-assumed) credentials.
+func route53ClientForRole(sess *session.Session, roleARN string) *route53.Route53 {
+	roleClientsMu.Lock()
+	defer roleClientsMu.Unlock()
+
+	if rc, ok := roleClients[roleARN]; ok {
+		return rc.client
+	}
+
+	rc := &roleClient{creds: sess.Config.Credentials}
+	if roleARN != "" {
+		rc.creds = stscreds.NewCredentials(sess, roleARN)
+	}
+	rc.client = route53.New(sess, aws.NewConfig().WithCredentials(rc.creds))
+
+	roleClients[roleARN] = rc
+	return rc.client
+}
+
+// expireRoleClients forces every cached role's credentials to refresh on
+// next use, the same way the base session's credentials are refreshed today.
+func expireRoleClients() {
+	roleClientsMu.Lock()
+	defer roleClientsMu.Unlock()
+	for _, rc := range roleClients {
+		rc.creds.Expire()
+	}
+}
+
+// defaultCNAMETTL is used for CNAME records when CNAME_TTL isn't set.
+const defaultCNAMETTL = 60
+
+// cnameTTL is the TTL applied to CNAME records (ALIAS records have no TTL).
+var cnameTTL int64
+
+// govCloudRegions don't support Route53 ALIAS records, so targets there must
+// always be emitted as CNAMEs.
+var govCloudRegions = map[string]bool{
+	"us-gov-west-1": true,
+	"us-gov-east-1": true,
+}
+
+// cnameRegions holds user-declared regions (via the CNAME_REGIONS env var)
+// that should also fall back to CNAME records instead of ALIAS records.
+var cnameRegions = map[string]bool{}
+
+// useCNAME reports whether records in region should be created as CNAME
+// records instead of ALIAS records.
+func useCNAME(region string) bool {
+	return govCloudRegions[region] || cnameRegions[region]
+}
+
+// ownerHeritage identifies TXT records written by this controller so that
+// pruning never touches records it doesn't own.
+const ownerHeritage = "heritage=route53-kubernetes"
+
+// ownerValue returns the quoted TXT record value recording which Service
+// owns a given domain, modeled after the external-dns registry TXT records.
+func ownerValue(s *v1.Service) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%s,owner=%s/%s", ownerHeritage, s.Namespace, s.Name))
+}
+
+// ownerKey returns the namespace/name key used to identify a Service.
+func ownerKey(s *v1.Service) string {
+	return fmt.Sprintf("%s/%s", s.Namespace, s.Name)
+}
+
+// serviceSpec captures the fields of a Service that affect its Route53
+// records. Two equal serviceSpecs need no further Route53 writes.
+type serviceSpec struct {
+	hostname             string
+	domainName           string
+	external             bool
+	roleARN              string
+	recordType           string
+	ttl                  int64
+	evaluateTargetHealth bool
+}
+
+const (
+	// externalHostnameAnnotation points at a hostname outside the cluster
+	// (e.g. a CDN) to record instead of the Service's own ELB ingress.
+	externalHostnameAnnotation = "route53.amazonaws.com/externalHostname"
+	// ttlAnnotation sets the TTL for CNAME records (ALIAS records have no TTL).
+	ttlAnnotation = "route53.amazonaws.com/ttl"
+	// typeAnnotation picks the record type; defaults to "A".
+	typeAnnotation = "route53.amazonaws.com/type"
+	// evaluateTargetHealthAnnotation controls AliasTarget.EvaluateTargetHealth; defaults to false.
+	evaluateTargetHealthAnnotation = "route53.amazonaws.com/evaluateTargetHealth"
+)
+
+// validRecordTypes are the record types we know how to build a ResourceRecordSet for.
+var validRecordTypes = map[string]bool{"A": true, "AAAA": true, "CNAME": true}
+
+// specFor extracts the serviceSpec for s, returning ok=false if s isn't
+// eligible for DNS management (no ingress hostname yet, or no domainName
+// annotation).
+func specFor(s *v1.Service) (serviceSpec, bool) {
+	var spec serviceSpec
+
+	if hn, ok := s.ObjectMeta.Annotations[externalHostnameAnnotation]; ok {
+		spec.hostname = hn
+		spec.external = true
+	} else {
+		hn, err := serviceHostname(s)
+		if err != nil {
+			return spec, false
+		}
+		spec.hostname = hn
+	}
+
+	domainName, ok := s.ObjectMeta.Annotations["domainName"]
+	if !ok {
+		return spec, false
+	}
+	spec.domainName = domainName
+
+	spec.roleARN = baseRoleARN
+	if roleARN, ok := s.ObjectMeta.Annotations[roleArnAnnotation]; ok && roleARN != "" {
+		spec.roleARN = roleARN
+	}
+
+	spec.recordType = "A"
+	if t, ok := s.ObjectMeta.Annotations[typeAnnotation]; ok {
+		t = strings.ToUpper(t)
+		if !validRecordTypes[t] {
+			log.Printf("warning! Invalid %s annotation %q for %s, falling back to A\n", typeAnnotation, t, s.Name)
+		} else {
+			spec.recordType = t
+		}
+	}
+
+	spec.ttl = cnameTTL
+	if ttlStr, ok := s.ObjectMeta.Annotations[ttlAnnotation]; ok {
+		ttl, err := strconv.ParseInt(ttlStr, 10, 64)
+		if err != nil || ttl < 0 {
+			log.Printf("warning! Invalid %s annotation %q for %s, falling back to %ds\n", ttlAnnotation, ttlStr, s.Name, cnameTTL)
+		} else {
+			spec.ttl = ttl
+		}
+	}
+
+	if evalStr, ok := s.ObjectMeta.Annotations[evaluateTargetHealthAnnotation]; ok {
+		eval, err := strconv.ParseBool(evalStr)
+		if err != nil {
+			log.Printf("warning! Invalid %s annotation %q for %s, falling back to false\n", evaluateTargetHealthAnnotation, evalStr, s.Name)
+		} else {
+			spec.evaluateTargetHealth = eval
+		}
+	}
+
+	return spec, true
+}
+
+// trackedService pairs a Service with the serviceSpec computed for it.
+type trackedService struct {
+	service *v1.Service
+	spec    serviceSpec
+}
+
+var (
+	knownMu sync.Mutex
+	// known holds, by Service UID, every Service currently matching the
+	// "dns=route53" selector and eligible for DNS management.
+	known = map[string]trackedService{}
+
+	lastAppliedMu sync.Mutex
+	// lastApplied holds, by Service UID, the serviceSpec last successfully
+	// pushed to Route53, so unchanged Services are skipped on reconcile.
+	lastApplied = map[string]serviceSpec{}
+
+	zoneClientsMu sync.Mutex
+	// zoneClients accumulates zoneID -> the client whose account owns it,
+	// across reconcile passes, so a zone already seen keeps being pruned
+	// even once no Service still claims a domain in it. A zone is dropped
+	// (via forgetZoneClient) once a prune pass finds nothing left to clean
+	// up in it and no known Service claims a domain in it, so a
+	// long-abandoned zone doesn't get swept forever.
+	zoneClients = map[string]*route53.Route53{}
+)
+
+func rememberZoneClient(zoneID string, r53Api *route53.Route53) {
+	zoneClientsMu.Lock()
+	zoneClients[zoneID] = r53Api
+	zoneClientsMu.Unlock()
+}
+
+func forgetZoneClient(zoneID string) {
+	zoneClientsMu.Lock()
+	delete(zoneClients, zoneID)
+	zoneClientsMu.Unlock()
+}
+
+// zoneClient returns the client that owns zoneID, or nil if reconcile has
+// never seen it or has since forgotten it.
+func zoneClient(zoneID string) *route53.Route53 {
+	zoneClientsMu.Lock()
+	defer zoneClientsMu.Unlock()
+	return zoneClients[zoneID]
+}
+
+// knownZoneClients returns a snapshot of every zone ID reconcile has ever
+// seen, mapped to the client that owns it.
+func knownZoneClients() map[string]*route53.Route53 {
+	zoneClientsMu.Lock()
+	defer zoneClientsMu.Unlock()
+	snapshot := make(map[string]*route53.Route53, len(zoneClients))
+	for zoneID, r53Api := range zoneClients {
+		snapshot[zoneID] = r53Api
+	}
+	return snapshot
+}
+
+// serviceAdded and serviceUpdated both just need the newest Service state.
+func serviceAdded(obj interface{})              { trackService(obj.(*v1.Service)) }
+func serviceUpdated(oldObj, newObj interface{}) { trackService(newObj.(*v1.Service)) }
+
+// trackService records s's current spec (or drops it if it's no longer
+// eligible, e.g. its domainName annotation was removed) and asks for a
+// reconcile.
+func trackService(s *v1.Service) {
+	uid := string(s.ObjectMeta.UID)
+	spec, ok := specFor(s)
+
+	knownMu.Lock()
+	if ok {
+		known[uid] = trackedService{service: s, spec: spec}
+	} else {
+		delete(known, uid)
+	}
+	knownMu.Unlock()
+
+	if !ok {
+		forgetLastApplied(uid)
+	}
+	requestReconcile()
+}
+
+// serviceDeleted drops a Service the informer has filtered out, whether
+// because it was deleted outright or it no longer matches our selector
+// (e.g. the "dns=route53" label was removed).
+func serviceDeleted(obj interface{}) {
+	s, ok := obj.(*v1.Service)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			log.Println("warning! Couldn't decode deleted object, ignoring")
+			return
+		}
+		s, ok = tombstone.Obj.(*v1.Service)
+		if !ok {
+			log.Println("warning! Tombstone contained non-Service object, ignoring")
+			return
+		}
+	}
+
+	uid := string(s.ObjectMeta.UID)
+	knownMu.Lock()
+	delete(known, uid)
+	knownMu.Unlock()
+	forgetLastApplied(uid)
+	requestReconcile()
+}
+
+func forgetLastApplied(uid string) {
+	lastAppliedMu.Lock()
+	delete(lastApplied, uid)
+	lastAppliedMu.Unlock()
 }
 
 func main() {
@@ -64,9 +412,10 @@ func main() {
 	awsConfig.WithRegion(region)
 	sess := session.New(awsConfig)
 
-	r53Api := route53.New(sess)
+	r53Api := route53ClientForRole(sess, "")
 	elbAPI := elb.New(sess)
-	if r53Api == nil || elbAPI == nil {
+	elbv2API := elbv2.New(sess)
+	if r53Api == nil || elbAPI == nil || elbv2API == nil {
 		panic("Failed to make AWS connection")
 	}
 
@@ -75,72 +424,196 @@ func main() {
 	if err != nil {
 		panic(fmt.Sprintf("Failed to parse selector %q: %v", selector, err))
 	}
-	listOptions := api.ListOptions{
-		LabelSelector: l,
-	}
 
-	log.Println("Starting Service Polling every 30s")
+	_, controller := cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = l
+				return clientset.Services(api.NamespaceAll).List(options)
+			},
+			WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = l
+				return clientset.Services(api.NamespaceAll).Watch(options)
+			},
+		},
+		&v1.Service{},
+		0, // no periodic resync; we react to watch events directly
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    serviceAdded,
+			UpdateFunc: serviceUpdated,
+			DeleteFunc: serviceDeleted,
+		},
+	)
+
+	log.Println("Watching Services with selector", selector)
+	stop := make(chan struct{})
+	go controller.Run(stop)
+
+	go func() {
+		ticker := time.NewTicker(reconcileResyncPeriod)
+		defer ticker.Stop()
+		for range ticker.C {
+			requestReconcile()
+		}
+	}()
+
 	awsCallFailed := false
-	for {
+	for range reconcileRequested {
+		time.Sleep(reconcileDebounce)
+		drainReconcileRequests()
+
 		if awsCallFailed {
 			log.Println("Noticed failed calls to AWS services, refreshing creds")
-			sess.Config.Credentials.Expire()
+			expireRoleClients()
 			awsCallFailed = false
 		}
 
-		services, err := clientset.Services(api.NamespaceAll).List(listOptions)
-		if err != nil {
-			panic(fmt.Sprintf("Failed to list pods: %v", err))
+		if reconcile(sess, elbAPI, elbv2API, region) {
+			awsCallFailed = true
 		}
+	}
+}
+
+// drainReconcileRequests discards any reconcile requests that piled up
+// during reconcileDebounce, since the reconcile about to run covers them.
+func drainReconcileRequests() {
+	for {
+		select {
+		case <-reconcileRequested:
+		default:
+			return
+		}
+	}
+}
 
-		log.Printf("Found %d DNS services in all namespaces with selector %q\n", len(services.Items), selector)
-		for i := range services.Items {
-			s := &services.Items[i]
-			hn, err := serviceHostname(s)
+// reconcile pushes Route53 changes for every known Service whose spec has
+// changed since it was last applied, then prunes orphaned records in every
+// zone reconcile has ever seen, even one no known Service claims a domain
+// in any more. It returns true if any AWS call failed.
+func reconcile(sess *session.Session, elbAPI *elb.ELB, elbv2API *elbv2.ELBV2, region string) bool {
+	knownMu.Lock()
+	snapshot := make(map[string]trackedService, len(known))
+	for uid, ts := range known {
+		snapshot[uid] = ts
+	}
+	knownMu.Unlock()
+
+	log.Printf("Reconciling %d DNS services\n", len(snapshot))
+	awsCallFailed := false
+	claimed := map[string]string{}                  // domain -> owning Service, e.g. "default/foo"
+	changesByZone := map[string][]*route53.Change{} // zoneID -> pending changes, flushed once per pass
+	pendingApply := map[string]serviceSpec{}        // uid -> spec, applied once every zone below flushes cleanly
+	serviceZones := map[string][]string{}           // uid -> zoneIDs its changes were queued into
+	claimedZones := map[string]bool{}               // zoneIDs a known Service claims a domain in this pass
+
+	for uid, ts := range snapshot {
+		s := ts.service
+		spec := ts.spec
+		r53Api := route53ClientForRole(sess, spec.roleARN)
+
+		lastAppliedMu.Lock()
+		prev, hadPrev := lastApplied[uid]
+		lastAppliedMu.Unlock()
+		changed := !hadPrev || prev != spec
+		serviceFailed := false
+
+		domains := strings.Split(spec.domainName, ",")
+		for _, domain := range domains {
+			fqdn := strings.TrimLeft(domain, ".")
+			claimed[domainWithTrailingDot(fqdn)] = ownerKey(s)
+
+			zone, err := getDestinationZone(domain, r53Api)
 			if err != nil {
-				log.Println("warning! Couldn't find hostname for", s.Name, err)
+				log.Println("warning! Couldn't find destination zone:", err)
+				awsCallFailed = true
+				serviceFailed = true
 				continue
 			}
 
-			annotation, ok := s.ObjectMeta.Annotations["domainName"]
-			if !ok {
-				log.Println("warning! Domain name not set for", s.Name)
+			zoneID := *zone.Id
+			zoneParts := strings.Split(zoneID, "/")
+			zoneID = zoneParts[len(zoneParts)-1]
+
+			rememberZoneClient(zoneID, r53Api)
+			claimedZones[zoneID] = true
+
+			if !changed {
 				continue
 			}
 
-			domains := strings.Split(annotation, ",")
-			for j := range domains {
-				domain := domains[j]
-
-				log.Printf("Creating DNS for %s service: %s -> %s\n", s.Name, hn, domain)
-				elbZoneID, err := hostedZoneID(elbAPI, hn)
+			log.Printf("Creating DNS for %s service: %s -> %s\n", s.Name, spec.hostname, domain)
+			var elbZoneID string
+			if !spec.external {
+				var err error
+				elbZoneID, err = hostedZoneID(elbAPI, elbv2API, spec.hostname)
 				if err != nil {
 					log.Println("warning! Couldn't get zone ID:", err)
 					awsCallFailed = true
+					serviceFailed = true
 					continue
 				}
+			}
 
-				zone, err := getDestinationZone(domain, r53Api)
-				if err != nil {
-					log.Println("warning! Couldn't find destination zone:", err)
-					awsCallFailed = true
-					continue
-				}
+			changesByZone[zoneID] = append(changesByZone[zoneID], buildChanges(s, spec.hostname, elbZoneID, fqdn, region, spec.external, spec.recordType, spec.ttl, spec.evaluateTargetHealth)...)
+			serviceZones[uid] = append(serviceZones[uid], zoneID)
+		}
 
-				zoneID := *zone.Id
-				zoneParts := strings.Split(zoneID, "/")
-				zoneID = zoneParts[len(zoneParts)-1]
+		// Only a candidate for lastApplied once every domain for it was
+		// processed without error; the write itself waits until its zones'
+		// changes are actually flushed below, so a failed
+		// ChangeResourceRecordSets call doesn't get silently marked applied.
+		if changed && !serviceFailed {
+			pendingApply[uid] = spec
+		}
+	}
 
-				if err = updateDNS(r53Api, hn, elbZoneID, strings.TrimLeft(domain, "."), zoneID); err != nil {
-					log.Println("warning!", err)
-					awsCallFailed = true
-					continue
+	if prune {
+		zones := knownZoneClients()
+		log.Printf("Sweeping %d known zones for orphaned records\n", len(zones))
+		for zoneID, r53Api := range zones {
+			pruneChanges, err := collectPruneChanges(r53Api, zoneID, claimed)
+			if err != nil {
+				log.Println("warning! Failed to collect orphaned records:", err)
+				awsCallFailed = true
+				continue
+			}
+			if len(pruneChanges) == 0 {
+				// Nothing left to clean up here; stop sweeping this zone
+				// until a Service claims it again.
+				if !claimedZones[zoneID] {
+					forgetZoneClient(zoneID)
 				}
-				log.Printf("Created dns record set: domain=%s, zoneID=%s\n", domain, zoneID)
+				continue
 			}
+			changesByZone[zoneID] = append(changesByZone[zoneID], pruneChanges...)
 		}
-		time.Sleep(30 * time.Second)
 	}
+
+	zoneFailed := map[string]bool{}
+	for zoneID, changes := range changesByZone {
+		if err := flushChangeBatch(zoneClient(zoneID), zoneID, changes); err != nil {
+			log.Println("warning! Failed to flush changes for zone", zoneID, err)
+			awsCallFailed = true
+			zoneFailed[zoneID] = true
+		}
+	}
+
+	for uid, spec := range pendingApply {
+		applied := true
+		for _, zoneID := range serviceZones[uid] {
+			if zoneFailed[zoneID] {
+				applied = false
+				break
+			}
+		}
+		if applied {
+			lastAppliedMu.Lock()
+			lastApplied[uid] = spec
+			lastAppliedMu.Unlock()
+		}
+	}
+
+	return awsCallFailed
 }
 
 func getClientset() (*kubernetes.Clientset, error) {
@@ -157,22 +630,109 @@ func getClientset() (*kubernetes.Clientset, error) {
 	return clientset, nil
 }
 
+// zoneCacheTTL bounds how long a resolved domain -> HostedZone mapping is
+// trusted before getDestinationZone re-lists zones from Route53.
+const zoneCacheTTL = 5 * time.Minute
+
+type zoneCacheEntry struct {
+	zone    *route53.HostedZone
+	expires time.Time
+}
+
+var (
+	zoneCacheMu sync.Mutex
+	// zoneCache is keyed first by the Route53 client (each AWS account has
+	// its own zone namespace), then by domain.
+	zoneCache = map[*route53.Route53]map[string]zoneCacheEntry{}
+)
+
+func cachedZone(r53Api *route53.Route53, domain string) (*route53.HostedZone, bool) {
+	zoneCacheMu.Lock()
+	defer zoneCacheMu.Unlock()
+
+	entry, ok := zoneCache[r53Api][domain]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.zone, true
+}
+
+func cacheZone(r53Api *route53.Route53, domain string, zone *route53.HostedZone) {
+	zoneCacheMu.Lock()
+	defer zoneCacheMu.Unlock()
+
+	if zoneCache[r53Api] == nil {
+		zoneCache[r53Api] = map[string]zoneCacheEntry{}
+	}
+	zoneCache[r53Api][domain] = zoneCacheEntry{zone: zone, expires: time.Now().Add(zoneCacheTTL)}
+}
+
+// invalidateZoneCache drops every zone cached for r53Api after a Route53
+// API error, since we can no longer trust it reflects reality.
+func invalidateZoneCache(r53Api *route53.Route53) {
+	zoneCacheMu.Lock()
+	defer zoneCacheMu.Unlock()
+	delete(zoneCache, r53Api)
+}
+
 func getDestinationZone(domain string, r53Api *route53.Route53) (*route53.HostedZone, error) {
+	if zone, ok := cachedZone(r53Api, domain); ok {
+		return zone, nil
+	}
+
 	tld, err := getTLD(domain)
 	if err != nil {
 		return nil, err
 	}
 
-	listHostedZoneInput := route53.ListHostedZonesByNameInput{
-		DNSName: &tld,
-	}
-	hzOut, err := r53Api.ListHostedZonesByName(&listHostedZoneInput)
+	zones, err := listHostedZonesByTLD(r53Api, tld)
 	if err != nil {
+		invalidateZoneCache(r53Api)
 		return nil, fmt.Errorf("No zone found for %s: %v", tld, err)
 	}
-	// TODO: The AWS API may return multiple pages, we should parse them all
 
-	return findMostSpecificZoneForDomain(domain, hzOut.HostedZones)
+	zone, err := findMostSpecificZoneForDomain(domain, zones)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheZone(r53Api, domain, zone)
+	return zone, nil
+}
+
+// listHostedZonesByTLD pages through ListHostedZonesByName, collecting every
+// zone whose name is tld or ends in it (tld's own zone and any subdomain
+// zones under it). Route53 returns zones in
+// name order starting at tld, so once a page comes back with no zone
+// sharing tld's suffix we've moved past every relevant zone and can stop,
+// rather than paging through the rest of the account's zones.
+func listHostedZonesByTLD(r53Api *route53.Route53, tld string) ([]*route53.HostedZone, error) {
+	dottedTLD := domainWithTrailingDot(tld)
+	input := route53.ListHostedZonesByNameInput{DNSName: &tld}
+
+	var matches []*route53.HostedZone
+	for {
+		out, err := r53Api.ListHostedZonesByName(&input)
+		if err != nil {
+			return nil, err
+		}
+
+		stillMatching := false
+		for _, zone := range out.HostedZones {
+			if strings.HasSuffix(*zone.Name, dottedTLD) {
+				matches = append(matches, zone)
+				stillMatching = true
+			}
+		}
+
+		if !stillMatching || out.NextDNSName == nil {
+			break
+		}
+		input.DNSName = out.NextDNSName
+		input.HostedZoneId = out.NextHostedZoneId
+	}
+
+	return matches, nil
 }
 
 func findMostSpecificZoneForDomain(domain string, zones []*route53.HostedZone) (*route53.HostedZone, error) {
@@ -243,7 +803,41 @@ func loadBalancerNameFromHostname(hostname string) (string, error) {
 	return name, nil
 }
 
-func hostedZoneID(elbAPI *elb.ELB, hostname string) (string, error) {
+// isELBv2Hostname reports whether hostname looks like an NLB/ALB hostname
+// (name-hash.elb.region.amazonaws.com) rather than a classic ELB hostname
+// (name-1234.region.elb.amazonaws.com or internal-name-1234.region.elb.amazonaws.com).
+func isELBv2Hostname(hostname string) bool {
+	parts := strings.SplitN(hostname, ".", 2)
+	return len(parts) == 2 && strings.HasPrefix(parts[1], "elb.")
+}
+
+// loadBalancerV2NameFromHostname extracts the load balancer name from an
+// NLB/ALB hostname, stripping the trailing "-hash" label the ELBv2 console
+// appends to keep hostnames unique.
+func loadBalancerV2NameFromHostname(hostname string) (string, error) {
+	label := strings.SplitN(hostname, ".", 2)[0]
+
+	// handle internal load balancer naming, same as loadBalancerNameFromHostname
+	label = strings.TrimPrefix(label, "internal-")
+
+	idx := strings.LastIndex(label, "-")
+	if idx < 1 {
+		return "", fmt.Errorf("%s is not a valid ELBv2 hostname", hostname)
+	}
+	return label[:idx], nil
+}
+
+// hostedZoneID returns the HostedZoneId to use as the ALIAS target for
+// hostname, dispatching to the classic ELB or ELBv2 (NLB/ALB) API depending
+// on the hostname's shape.
+func hostedZoneID(elbAPI *elb.ELB, elbv2API *elbv2.ELBV2, hostname string) (string, error) {
+	if isELBv2Hostname(hostname) {
+		return hostedZoneIDv2(elbv2API, hostname)
+	}
+	return hostedZoneIDClassic(elbAPI, hostname)
+}
+
+func hostedZoneIDClassic(elbAPI *elb.ELB, hostname string) (string, error) {
 	elbName, err := loadBalancerNameFromHostname(hostname)
 	if err != nil {
 		return "", fmt.Errorf("Couldn't parse ELB hostname: %v", err)
@@ -267,37 +861,239 @@ func hostedZoneID(elbAPI *elb.ELB, hostname string) (string, error) {
 	return *descs[0].CanonicalHostedZoneNameID, nil
 }
 
-func updateDNS(r53Api *route53.Route53, hn, hzID, domain, zoneID string) error {
-	at := route53.AliasTarget{
-		DNSName:              &hn,
-		EvaluateTargetHealth: aws.Bool(false),
-		HostedZoneId:         &hzID,
+func hostedZoneIDv2(elbv2API *elbv2.ELBV2, hostname string) (string, error) {
+	elbName, err := loadBalancerV2NameFromHostname(hostname)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't parse ELBv2 hostname: %v", err)
 	}
-	rrs := route53.ResourceRecordSet{
-		AliasTarget: &at,
-		Name:        &domain,
-		Type:        aws.String("A"),
+	lbInput := &elbv2.DescribeLoadBalancersInput{
+		Names: []*string{
+			&elbName,
+		},
 	}
-	change := route53.Change{
-		Action:            aws.String("UPSERT"),
-		ResourceRecordSet: &rrs,
+	resp, err := elbv2API.DescribeLoadBalancers(lbInput)
+	if err != nil {
+		return "", fmt.Errorf("Could not describe load balancer: %v", err)
 	}
-	batch := route53.ChangeBatch{
-		Changes: []*route53.Change{&change},
-		Comment: aws.String("Kubernetes Update to Service"),
+	lbs := resp.LoadBalancers
+	if len(lbs) < 1 {
+		return "", fmt.Errorf("No lb found: %v", err)
 	}
-	crrsInput := route53.ChangeResourceRecordSetsInput{
-		ChangeBatch:  &batch,
+	if len(lbs) > 1 {
+		return "", fmt.Errorf("Multiple lbs found: %v", err)
+	}
+	return *lbs[0].CanonicalHostedZoneId, nil
+}
+
+// buildResourceRecordSet builds an ALIAS record (type recordType, normally
+// "A" or "AAAA") pointing at an AWS ELB, or a plain CNAME record with the
+// given ttl when ALIAS isn't usable or wasn't requested: in GovCloud regions
+// (and any user-declared region via CNAME_REGIONS), when the target isn't an
+// AWS-owned ELB at all (external hostnames can never be ALIAS targets), or
+// when recordType is explicitly "CNAME".
+func buildResourceRecordSet(hn, hzID, domain, region string, external bool, recordType string, ttl int64, evaluateTargetHealth bool) route53.ResourceRecordSet {
+	if !external && recordType != "CNAME" && !useCNAME(region) {
+		return route53.ResourceRecordSet{
+			Name: &domain,
+			Type: aws.String(recordType),
+			AliasTarget: &route53.AliasTarget{
+				DNSName:              &hn,
+				EvaluateTargetHealth: aws.Bool(evaluateTargetHealth),
+				HostedZoneId:         &hzID,
+			},
+		}
+	}
+
+	return route53.ResourceRecordSet{
+		Name: &domain,
+		Type: aws.String("CNAME"),
+		TTL:  aws.Int64(ttl),
+		ResourceRecords: []*route53.ResourceRecord{
+			{Value: &hn},
+		},
+	}
+}
+
+// buildChanges returns the UPSERT changes needed to point domain at hn: the
+// ALIAS/CNAME record itself plus its owner TXT record.
+func buildChanges(s *v1.Service, hn, hzID, domain, region string, external bool, recordType string, ttl int64, evaluateTargetHealth bool) []*route53.Change {
+	rrs := buildResourceRecordSet(hn, hzID, domain, region, external, recordType, ttl, evaluateTargetHealth)
+
+	ownerRrs := route53.ResourceRecordSet{
+		Name: &domain,
+		Type: aws.String("TXT"),
+		TTL:  aws.Int64(300),
+		ResourceRecords: []*route53.ResourceRecord{
+			{Value: aws.String(ownerValue(s))},
+		},
+	}
+
+	return []*route53.Change{
+		{Action: aws.String("UPSERT"), ResourceRecordSet: &rrs},
+		{Action: aws.String("UPSERT"), ResourceRecordSet: &ownerRrs},
+	}
+}
+
+// collectPruneChanges returns DELETE changes for the ALIAS/CNAME and owner TXT
+// records of any domain this controller previously claimed in zoneID but
+// that no longer appears in claimed (i.e. the owning Service was deleted,
+// unlabeled, or dropped the domain from its domainName annotation).
+func collectPruneChanges(r53Api *route53.Route53, zoneID string, claimed map[string]string) ([]*route53.Change, error) {
+	input := route53.ListResourceRecordSetsInput{
 		HostedZoneId: &zoneID,
 	}
+
+	var toDelete []*route53.ResourceRecordSet
+	err := r53Api.ListResourceRecordSetsPages(&input, func(out *route53.ListResourceRecordSetsOutput, lastPage bool) bool {
+		for _, rrs := range out.ResourceRecordSets {
+			if rrs.Type == nil || *rrs.Type != "TXT" || len(rrs.ResourceRecords) < 1 {
+				continue
+			}
+			value := aws.StringValue(rrs.ResourceRecords[0].Value)
+			if !strings.Contains(value, ownerHeritage) {
+				continue
+			}
+			if _, stillClaimed := claimed[aws.StringValue(rrs.Name)]; stillClaimed {
+				continue
+			}
+			toDelete = append(toDelete, rrs)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list record sets for zone %s: %v", zoneID, err)
+	}
+
+	var changes []*route53.Change
+	for _, txtRrs := range toDelete {
+		name := aws.StringValue(txtRrs.Name)
+
+		aRrs, err := findRecordSet(r53Api, zoneID, name)
+		if err != nil {
+			log.Println("warning! Couldn't find owned record to prune for", name, err)
+			continue
+		}
+
+		changes = append(changes, &route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: txtRrs})
+		if aRrs != nil {
+			changes = append(changes, &route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: aRrs})
+		}
+		log.Printf("Queued prune of orphaned dns record set: domain=%s, zoneID=%s\n", name, zoneID)
+	}
+
+	return changes, nil
+}
+
+const (
+	// maxBatchElements is Route53's limit on "values" per ChangeResourceRecordSets call.
+	maxBatchElements = 1000
+	// maxBatchChars is Route53's limit on total characters across all Value fields in a batch.
+	maxBatchChars = 32000
+)
+
+// changeElements returns the number of elements a Change counts for against
+// maxBatchElements, doubled for UPSERT since Route53 treats it as a DELETE
+// plus a CREATE.
+func changeElements(c *route53.Change) int {
+	n := 1
+	if rrs := c.ResourceRecordSet; rrs != nil && len(rrs.ResourceRecords) > 0 {
+		n = len(rrs.ResourceRecords)
+	}
+	if aws.StringValue(c.Action) == "UPSERT" {
+		n *= 2
+	}
+	return n
+}
+
+// changeChars returns the number of characters a Change counts for against
+// maxBatchChars, doubled for UPSERT.
+func changeChars(c *route53.Change) int {
+	chars := 0
+	if rrs := c.ResourceRecordSet; rrs != nil {
+		for _, rr := range rrs.ResourceRecords {
+			chars += len(aws.StringValue(rr.Value))
+		}
+	}
+	if aws.StringValue(c.Action) == "UPSERT" {
+		chars *= 2
+	}
+	return chars
+}
+
+// flushChangeBatch sends changes to zoneID in as few ChangeResourceRecordSets
+// calls as Route53's per-batch limits allow: it greedily packs changes until
+// the next one would exceed maxBatchElements or maxBatchChars, sends that
+// batch, and keeps going. A failed batch is logged and skipped rather than
+// aborting the remaining batches.
+func flushChangeBatch(r53Api *route53.Route53, zoneID string, changes []*route53.Change) error {
+	var batch []*route53.Change
+	elements, chars := 0, 0
+	var lastErr error
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := sendChangeBatch(r53Api, zoneID, batch); err != nil {
+			log.Printf("warning! Batch of %d changes failed for zone %s: %v\n", len(batch), zoneID, err)
+			lastErr = err
+		} else {
+			log.Printf("Submitted batch of %d changes to zone %s\n", len(batch), zoneID)
+		}
+		batch, elements, chars = nil, 0, 0
+	}
+
+	for _, c := range changes {
+		ce, cc := changeElements(c), changeChars(c)
+		if len(batch) > 0 && (elements+ce > maxBatchElements || chars+cc > maxBatchChars) {
+			flush()
+		}
+		batch = append(batch, c)
+		elements += ce
+		chars += cc
+	}
+	flush()
+
+	return lastErr
+}
+
+// sendChangeBatch submits a single ChangeResourceRecordSets call, or logs
+// what it would have sent when DRY_RUN is set.
+func sendChangeBatch(r53Api *route53.Route53, zoneID string, changes []*route53.Change) error {
 	if dryRun {
-		log.Printf("DRY RUN: We normally would have updated %s to point to %s (%s)\n", zoneID, hzID, hn)
+		log.Printf("DRY RUN: We normally would have submitted %d changes to zone %s\n", len(changes), zoneID)
 		return nil
 	}
 
-	_, err := r53Api.ChangeResourceRecordSets(&crrsInput)
+	_, err := r53Api.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: &zoneID,
+		ChangeBatch: &route53.ChangeBatch{
+			Changes: changes,
+			Comment: aws.String("Kubernetes Update to Service"),
+		},
+	})
 	if err != nil {
-		return fmt.Errorf("Failed to update record set: %v", err)
+		return fmt.Errorf("Failed to update record sets: %v", err)
 	}
 	return nil
 }
+
+// findRecordSet looks up the non-TXT record for name in zoneID so that a
+// DELETE change can be submitted with the exact ResourceRecordSet Route53
+// already has on file, which AWS requires for deletes to succeed.
+func findRecordSet(r53Api *route53.Route53, zoneID, name string) (*route53.ResourceRecordSet, error) {
+	out, err := r53Api.ListResourceRecordSets(&route53.ListResourceRecordSetsInput{
+		HostedZoneId:    &zoneID,
+		StartRecordName: &name,
+		MaxItems:        aws.String("10"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, rrs := range out.ResourceRecordSets {
+		if aws.StringValue(rrs.Name) == name && aws.StringValue(rrs.Type) != "TXT" {
+			return rrs, nil
+		}
+	}
+	return nil, nil
+}
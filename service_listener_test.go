@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+func TestIsELBv2Hostname(t *testing.T) {
+	cases := []struct {
+		hostname string
+		want     bool
+	}{
+		{"a1234567890abcdef.elb.us-west-2.amazonaws.com", true},
+		{"internal-a1234567890abcdef.elb.us-west-2.amazonaws.com", true},
+		{"my-classic-elb-1234567890.us-west-2.elb.amazonaws.com", false},
+		{"internal-my-classic-elb-1234567890.us-west-2.elb.amazonaws.com", false},
+		{"notadottedhostname", false},
+	}
+
+	for _, c := range cases {
+		if got := isELBv2Hostname(c.hostname); got != c.want {
+			t.Errorf("isELBv2Hostname(%q) = %v, want %v", c.hostname, got, c.want)
+		}
+	}
+}
+
+func TestLoadBalancerNameFromHostname(t *testing.T) {
+	cases := []struct {
+		hostname string
+		want     string
+		wantErr  bool
+	}{
+		{"my-classic-elb-1234567890.us-west-2.elb.amazonaws.com", "my", false},
+		{"internal-my-classic-elb-1234567890.us-west-2.elb.amazonaws.com", "my", false},
+		{"noseparators", "", true},
+	}
+
+	for _, c := range cases {
+		got, err := loadBalancerNameFromHostname(c.hostname)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("loadBalancerNameFromHostname(%q) = %q, want error", c.hostname, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("loadBalancerNameFromHostname(%q) returned error: %v", c.hostname, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("loadBalancerNameFromHostname(%q) = %q, want %q", c.hostname, got, c.want)
+		}
+	}
+}
+
+func TestLoadBalancerV2NameFromHostname(t *testing.T) {
+	cases := []struct {
+		hostname string
+		want     string
+		wantErr  bool
+	}{
+		{"mylb-1234567890abcdef.elb.us-west-2.amazonaws.com", "mylb", false},
+		{"internal-mylb-1234567890abcdef.elb.us-west-2.amazonaws.com", "mylb", false},
+		{"internal-1234567890abcdef.elb.us-west-2.amazonaws.com", "", true},
+		{"nodashes.elb.us-west-2.amazonaws.com", "", true},
+	}
+
+	for _, c := range cases {
+		got, err := loadBalancerV2NameFromHostname(c.hostname)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("loadBalancerV2NameFromHostname(%q) = %q, want error", c.hostname, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("loadBalancerV2NameFromHostname(%q) returned error: %v", c.hostname, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("loadBalancerV2NameFromHostname(%q) = %q, want %q", c.hostname, got, c.want)
+		}
+	}
+}
+
+func changeWithValues(action string, values ...string) *route53.Change {
+	rrs := &route53.ResourceRecordSet{}
+	for _, v := range values {
+		rrs.ResourceRecords = append(rrs.ResourceRecords, &route53.ResourceRecord{Value: aws.String(v)})
+	}
+	return &route53.Change{
+		Action:            aws.String(action),
+		ResourceRecordSet: rrs,
+	}
+}
+
+func TestChangeElements(t *testing.T) {
+	cases := []struct {
+		name   string
+		change *route53.Change
+		want   int
+	}{
+		{"create, single value", changeWithValues("CREATE", "1.2.3.4"), 1},
+		{"create, multiple values", changeWithValues("CREATE", "1.2.3.4", "5.6.7.8"), 2},
+		{"upsert doubles", changeWithValues("UPSERT", "1.2.3.4"), 2},
+		{"delete, no resource records", &route53.Change{Action: aws.String("DELETE"), ResourceRecordSet: &route53.ResourceRecordSet{}}, 1},
+	}
+
+	for _, c := range cases {
+		if got := changeElements(c.change); got != c.want {
+			t.Errorf("%s: changeElements() = %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestChangeChars(t *testing.T) {
+	cases := []struct {
+		name   string
+		change *route53.Change
+		want   int
+	}{
+		{"create, single value", changeWithValues("CREATE", "1.2.3.4"), len("1.2.3.4")},
+		{"create, multiple values", changeWithValues("CREATE", "1.2.3.4", "5.6.7.8"), len("1.2.3.4") + len("5.6.7.8")},
+		{"upsert doubles", changeWithValues("UPSERT", "1.2.3.4"), len("1.2.3.4") * 2},
+	}
+
+	for _, c := range cases {
+		if got := changeChars(c.change); got != c.want {
+			t.Errorf("%s: changeChars() = %d, want %d", c.name, got, c.want)
+		}
+	}
+}